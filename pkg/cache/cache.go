@@ -1,11 +1,15 @@
 package main
 
 import (
+	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,30 +17,85 @@ var _ Cache = (*cache)(nil)
 
 var _ Cache = (*mutexCache)(nil)
 
-type Func func(key string) (interface{}, error)
+// ErrCacheClosed is returned by a channel-based cache's GetContext when the cache's
+// handleRequests goroutine has shut down before (or while) the request was being served.
+var ErrCacheClosed = errors.New("cache: closed")
+
+// Func fetches the value for key.  It is passed a context of its own that is canceled once every
+// caller waiting on the fetch has given up, so that an abandoned fetch can stop early.
+type Func func(ctx context.Context, key string) (interface{}, error)
 
 type (
+	// Cache memoizes the result of calling a Func, coalescing concurrent requests for the same
+	// key into a single call.
 	Cache interface {
 		Get(key string) response
+		GetContext(ctx context.Context, key string) response
+		Stats() Stats
+	}
+
+	// Config controls how long entries are kept and how many are retained at once.
+	Config struct {
+		// TTL is how long a successful result stays fresh.  Zero means it never expires.
+		TTL time.Duration
+
+		// NegativeTTL is how long an error result is cached before the next Get retries the
+		// fetch.  Zero means errors are never cached.
+		NegativeTTL time.Duration
+
+		// MaxEntries caps the number of entries retained, evicting the least recently used
+		// entry once the cap is exceeded.  Zero means unbounded.
+		MaxEntries int
+	}
+
+	// Stats is a snapshot of cache counters.
+	Stats struct {
+		Hits      uint64
+		Misses    uint64
+		Evictions uint64
+		Coalesced uint64
 	}
 
 	cache struct {
-		fn        Func
-		store     map[string]*entry
-		reqStream chan request
+		fn           Func
+		cfg          Config
+		store        map[string]*entry
+		reqStream    chan request
+		cancelStream chan cancelSignal
+		done         chan struct{}
+		lru          *list.List
+		index        map[string]*list.Element
+		hits         uint64
+		misses       uint64
+		evictions    uint64
+		coalesced    uint64
 	}
 
 	mutexCache struct {
-		fn    Func
-		store map[string]*entry
-		mu    *sync.Mutex
+		fn        Func
+		cfg       Config
+		store     map[string]*entry
+		mu        *sync.Mutex
+		lru       *list.List
+		index     map[string]*list.Element
+		hits      uint64
+		misses    uint64
+		evictions uint64
+		coalesced uint64
 	}
 )
 
 type request struct {
+	ctx      context.Context
 	url      string
 	response chan response
 }
+
+type cancelSignal struct {
+	key string
+	e   *entry
+}
+
 type response struct {
 	start time.Time
 	url   string
@@ -45,8 +104,12 @@ type response struct {
 }
 
 type entry struct {
-	res   response
-	ready chan int
+	mu        sync.Mutex
+	res       response
+	ready     chan struct{}
+	expiresAt time.Time
+	cancel    context.CancelFunc
+	waiters   int
 }
 
 func newEntry(key string) *entry {
@@ -54,100 +117,356 @@ func newEntry(key string) *entry {
 		res: response{
 			url: key,
 		},
-		ready: make(chan int),
+		ready: make(chan struct{}),
+	}
+}
+
+// expired reports whether the entry's cached result is past its TTL.  An entry still in flight,
+// or holding a successful result with no TTL configured, never expires; an error result with no
+// NegativeTTL configured is always expired, so errors are not cached.
+func (e *entry) expired() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.expiresAt.IsZero() {
+		return e.res.err != nil
 	}
+	return time.Now().After(e.expiresAt)
+}
+
+// expiresAtFor returns the absolute expiry for ttl, or the zero Time if ttl disables expiry.
+func expiresAtFor(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
 }
 
 func (c *cache) Get(key string) response {
-	respStream := make(chan response)
-	c.reqStream <- request{
-		url:      key,
-		response: respStream,
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext behaves like Get but returns early with a ctx.Err() result if ctx is done before the
+// value is ready.  The underlying fetch keeps running for any other waiters on the same entry;
+// only once every waiter has given up is the fetch's context canceled and the entry evicted so
+// the next Get re-fetches.
+func (c *cache) GetContext(ctx context.Context, key string) response {
+	respStream := make(chan response, 1)
+	req := request{ctx: ctx, url: key, response: respStream}
+
+	select {
+	case c.reqStream <- req:
+	case <-ctx.Done():
+		return response{url: key, err: ctx.Err()}
+	case <-c.done:
+		return response{url: key, err: ErrCacheClosed}
+	}
+
+	select {
+	case res := <-respStream:
+		return res
+	case <-ctx.Done():
+		return response{url: key, err: ctx.Err()}
+	case <-c.done:
+		return response{url: key, err: ErrCacheClosed}
+	}
+}
+
+func (c *cache) Stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Coalesced: atomic.LoadUint64(&c.coalesced),
 	}
-	response := <-respStream
-	return response
 }
 
-func (c *cache) handleRequests(stop chan int, f Func) {
+// handleRequests is the single goroutine that owns c.store.  It closes c.done on the way out so
+// that any GetContext or awaitEntry call racing the shutdown notices rather than blocking on (or
+// panicking from) a send to reqStream/cancelStream that nobody will ever receive again.
+func (c *cache) handleRequests(stop chan int) {
+	defer close(c.done)
 	for {
 		select {
 		case <-stop:
-			close(c.reqStream)
 			log.Println("request handler is shutdown")
 			return
 
-		case req, ok := <-c.reqStream:
-			if !ok {
-				return
+		case sig := <-c.cancelStream:
+			if cur, ok := c.store[sig.key]; ok && cur == sig.e {
+				c.remove(sig.key)
 			}
-			key := req.url
-			e := c.store[key]
-			if e == nil {
-				e = newEntry(key)
-				c.store[key] = e
-
-				go func(e *entry) {
-					e.res.value, e.res.err = f(req.url)
-					close(e.ready)
-					req.response <- e.res
-				}(e)
-				continue
+
+		case req := <-c.reqStream:
+			c.dispatch(req)
+		}
+	}
+}
+
+func (c *cache) dispatch(req request) {
+	key := req.url
+	e := c.store[key]
+	if e != nil && e.expired() {
+		c.remove(key)
+		e = nil
+	}
+
+	if e == nil {
+		atomic.AddUint64(&c.misses, 1)
+		e = newEntry(key)
+		c.store[key] = e
+		c.touch(key)
+		c.evict()
+
+		fetchCtx, cancel := context.WithCancel(context.Background())
+		e.cancel = cancel
+		e.waiters = 1
+
+		go func(e *entry) {
+			value, err := c.fn(fetchCtx, key)
+			e.mu.Lock()
+			e.res.value, e.res.err = value, err
+			if err == nil {
+				e.expiresAt = expiresAtFor(c.cfg.TTL)
+			} else {
+				e.expiresAt = expiresAtFor(c.cfg.NegativeTTL)
+			}
+			e.mu.Unlock()
+			close(e.ready)
+		}(e)
+	} else {
+		atomic.AddUint64(&c.hits, 1)
+		c.touch(key)
+		e.mu.Lock()
+		e.waiters++
+		e.mu.Unlock()
+		atomic.AddUint64(&c.coalesced, 1)
+	}
+
+	go c.awaitEntry(req, e)
+}
+
+func (c *cache) awaitEntry(req request, e *entry) {
+	select {
+	case <-e.ready:
+		e.mu.Lock()
+		res := e.res
+		e.mu.Unlock()
+		req.response <- res
+
+	case <-req.ctx.Done():
+		e.mu.Lock()
+		e.waiters--
+		remaining := e.waiters
+		e.mu.Unlock()
+
+		if remaining == 0 {
+			e.cancel()
+			select {
+			case c.cancelStream <- cancelSignal{key: req.url, e: e}:
+			case <-c.done:
 			}
+		}
+
+		req.response <- response{url: req.url, err: req.ctx.Err()}
+	}
+}
+
+// touch marks key as most recently used.  It is a no-op when no MaxEntries cap is configured.
+func (c *cache) touch(key string) {
+	if c.cfg.MaxEntries <= 0 {
+		return
+	}
+	if el, ok := c.index[key]; ok {
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.index[key] = c.lru.PushFront(key)
+}
 
-			go func(e *entry) {
-				<-e.ready
-				req.response <- e.res
-			}(e)
+// evict removes the least recently used entries until the cache is back within MaxEntries.
+func (c *cache) evict() {
+	if c.cfg.MaxEntries <= 0 {
+		return
+	}
+	for len(c.store) > c.cfg.MaxEntries {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			return
 		}
+		c.remove(oldest.Value.(string))
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+func (c *cache) remove(key string) {
+	delete(c.store, key)
+	if el, ok := c.index[key]; ok {
+		c.lru.Remove(el)
+		delete(c.index, key)
 	}
 }
 
 func (c *mutexCache) Get(key string) response {
-	// Check for a cache hit, block until entry is ready if cache hit
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext behaves like Get but returns early with a ctx.Err() result if ctx is done before the
+// value is ready.  The underlying fetch keeps running for any other waiters on the same entry;
+// only once every waiter has given up is the fetch's context canceled and the entry evicted so
+// the next Get re-fetches.
+func (c *mutexCache) GetContext(ctx context.Context, key string) response {
 	c.mu.Lock()
 	e := c.store[key]
+	if e != nil && e.expired() {
+		c.removeLocked(key)
+		e = nil
+	}
 
 	if e == nil {
-		// Cache miss, create entry and return the lock
+		atomic.AddUint64(&c.misses, 1)
 		e = newEntry(key)
 		c.store[key] = e
+		c.touchLocked(key)
+		c.evictLocked()
+
+		fetchCtx, cancel := context.WithCancel(context.Background())
+		e.cancel = cancel
+		e.waiters = 1
 		c.mu.Unlock()
 
-		// Perform fetch and signal when ready
-		e.res.value, e.res.err = c.fn(key)
-		close(e.ready)
-		return e.res
+		go func(e *entry) {
+			value, err := c.fn(fetchCtx, key)
+			e.mu.Lock()
+			e.res.value, e.res.err = value, err
+			if err == nil {
+				e.expiresAt = expiresAtFor(c.cfg.TTL)
+			} else {
+				e.expiresAt = expiresAtFor(c.cfg.NegativeTTL)
+			}
+			e.mu.Unlock()
+			close(e.ready)
+		}(e)
+	} else {
+		atomic.AddUint64(&c.hits, 1)
+		c.touchLocked(key)
+		e.mu.Lock()
+		e.waiters++
+		e.mu.Unlock()
+		atomic.AddUint64(&c.coalesced, 1)
+		c.mu.Unlock()
+	}
+
+	return c.awaitEntry(ctx, key, e)
+}
+
+func (c *mutexCache) awaitEntry(ctx context.Context, key string, e *entry) response {
+	select {
+	case <-e.ready:
+		e.mu.Lock()
+		res := e.res
+		e.mu.Unlock()
+		return res
+
+	case <-ctx.Done():
+		e.mu.Lock()
+		e.waiters--
+		remaining := e.waiters
+		e.mu.Unlock()
+
+		if remaining == 0 {
+			e.cancel()
+			c.mu.Lock()
+			if cur, ok := c.store[key]; ok && cur == e {
+				c.removeLocked(key)
+			}
+			c.mu.Unlock()
+		}
+
+		return response{url: key, err: ctx.Err()}
 	}
+}
 
-	// Cache hit, return the lock and wait for ready signal
-	c.mu.Unlock()
-	<-e.ready
-	return e.res
+func (c *mutexCache) Stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Coalesced: atomic.LoadUint64(&c.coalesced),
+	}
+}
 
+// touchLocked marks key as most recently used.  Callers must hold c.mu.
+func (c *mutexCache) touchLocked(key string) {
+	if c.cfg.MaxEntries <= 0 {
+		return
+	}
+	if el, ok := c.index[key]; ok {
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.index[key] = c.lru.PushFront(key)
 }
 
-func NewCache(stop chan int, f Func) *cache {
+// evictLocked removes the least recently used entries until the cache is back within MaxEntries.
+// Callers must hold c.mu.
+func (c *mutexCache) evictLocked() {
+	if c.cfg.MaxEntries <= 0 {
+		return
+	}
+	for len(c.store) > c.cfg.MaxEntries {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			return
+		}
+		c.removeLocked(oldest.Value.(string))
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// removeLocked deletes key from the cache.  Callers must hold c.mu.
+func (c *mutexCache) removeLocked(key string) {
+	delete(c.store, key)
+	if el, ok := c.index[key]; ok {
+		c.lru.Remove(el)
+		delete(c.index, key)
+	}
+}
+
+func NewCache(stop chan int, f Func, cfg Config) *cache {
 	c := &cache{
-		fn:        f,
-		store:     make(map[string]*entry),
-		reqStream: make(chan request),
+		fn:           f,
+		cfg:          cfg,
+		store:        make(map[string]*entry),
+		reqStream:    make(chan request),
+		cancelStream: make(chan cancelSignal),
+		done:         make(chan struct{}),
+		lru:          list.New(),
+		index:        make(map[string]*list.Element),
 	}
 
-	go c.handleRequests(stop, f)
+	go c.handleRequests(stop)
 
 	return c
 }
 
-func NewMutexCache(f Func) *mutexCache {
+func NewMutexCache(f Func, cfg Config) *mutexCache {
 	return &mutexCache{
 		fn:    f,
+		cfg:   cfg,
 		store: make(map[string]*entry),
 		mu:    &sync.Mutex{},
+		lru:   list.New(),
+		index: make(map[string]*list.Element),
 	}
 }
 
-func httpGetBody(url string) (interface{}, error) {
-	resp, err := http.Get(url)
+func httpGetBody(ctx context.Context, url string) (interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -245,7 +564,13 @@ func urlConsumer(stop <-chan int, urlStream <-chan string, c Cache) <-chan respo
 func main() {
 	stop := make(chan int)
 
-	c := NewCache(stop, httpGetBody)
+	cfg := Config{
+		TTL:         30 * time.Second,
+		NegativeTTL: 5 * time.Second,
+		MaxEntries:  100,
+	}
+
+	c := NewCache(stop, httpGetBody, cfg)
 	urlStream := urlProducer(stop, 4)
 	respStream := urlConsumer(stop, urlStream, c)
 
@@ -261,6 +586,7 @@ func main() {
 	// Clean up the cache once done taking responses
 	log.Println("starting graceful shutdown")
 	close(stop)
-	<-c.reqStream
+	<-c.done
+	log.Printf("cache stats: %+v", c.Stats())
 	log.Println("shutdown complete, goodbye")
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCaches returns a channel-based and a mutex-based Cache wired to the same fn and cfg, so a
+// test can run the same assertions against both implementations with t.Run.
+func newCaches(t *testing.T, fn Func, cfg Config) map[string]Cache {
+	t.Helper()
+	stop := make(chan int)
+	t.Cleanup(func() { close(stop) })
+	return map[string]Cache{
+		"channel": NewCache(stop, fn, cfg),
+		"mutex":   NewMutexCache(fn, cfg),
+	}
+}
+
+func TestCacheCoalescesConcurrentRequests(t *testing.T) {
+	var calls int32
+	fn := func(ctx context.Context, key string) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return key, nil
+	}
+
+	for name, c := range newCaches(t, fn, Config{}) {
+		t.Run(name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if res := c.Get("key"); res.err != nil {
+						t.Errorf("unexpected error: %v", res.err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got := atomic.LoadInt32(&calls); got != 1 {
+				t.Errorf("fn called %d times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestCacheTTLExpiry(t *testing.T) {
+	var calls int32
+	fn := func(ctx context.Context, key string) (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+
+	for name, c := range newCaches(t, fn, Config{TTL: 20 * time.Millisecond}) {
+		t.Run(name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+
+			first := c.Get("key")
+			if second := c.Get("key"); second.value != first.value {
+				t.Errorf("got %v before TTL expires, want cached %v", second.value, first.value)
+			}
+
+			time.Sleep(30 * time.Millisecond)
+			if third := c.Get("key"); third.value == first.value {
+				t.Errorf("got stale %v after TTL expires, want a fresh fetch", third.value)
+			}
+		})
+	}
+}
+
+func TestCacheNegativeTTLExpiry(t *testing.T) {
+	var calls int32
+	errBoom := errors.New("boom")
+	fn := func(ctx context.Context, key string) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errBoom
+	}
+
+	for name, c := range newCaches(t, fn, Config{NegativeTTL: 20 * time.Millisecond}) {
+		t.Run(name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+
+			c.Get("key")
+			c.Get("key")
+			if got := atomic.LoadInt32(&calls); got != 1 {
+				t.Errorf("fn called %d times before negative TTL expires, want 1", got)
+			}
+
+			time.Sleep(30 * time.Millisecond)
+			c.Get("key")
+			if got := atomic.LoadInt32(&calls); got != 2 {
+				t.Errorf("fn called %d times after negative TTL expires, want 2", got)
+			}
+		})
+	}
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	fn := func(ctx context.Context, key string) (interface{}, error) {
+		return key, nil
+	}
+
+	for name, c := range newCaches(t, fn, Config{MaxEntries: 2}) {
+		t.Run(name, func(t *testing.T) {
+			c.Get("a")
+			c.Get("b")
+			c.Get("c")
+
+			if stats := c.Stats(); stats.Evictions == 0 {
+				t.Errorf("got 0 evictions, want at least 1 once MaxEntries is exceeded")
+			}
+		})
+	}
+}
+
+// TestCacheGetContextCancelKeepsFetchAliveForOtherWaiters exercises the coalescing contract: a
+// caller that cancels its context gets its own ctx error, and must not abort the fetch for another
+// caller still waiting on the same key.
+func TestCacheGetContextCancelKeepsFetchAliveForOtherWaiters(t *testing.T) {
+	var started, release chan struct{}
+	fn := func(ctx context.Context, key string) (interface{}, error) {
+		close(started)
+		select {
+		case <-release:
+			return key, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	for name, c := range newCaches(t, fn, Config{}) {
+		t.Run(name, func(t *testing.T) {
+			started = make(chan struct{})
+			release = make(chan struct{})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			canceling := make(chan response, 1)
+			go func() { canceling <- c.GetContext(ctx, "key") }()
+			<-started
+
+			staying := make(chan response, 1)
+			go func() { staying <- c.GetContext(context.Background(), "key") }()
+			time.Sleep(10 * time.Millisecond)
+
+			cancel()
+			if res := <-canceling; res.err == nil {
+				t.Fatalf("expected the canceled waiter to get an error")
+			}
+
+			close(release)
+			if res := <-staying; res.err != nil {
+				t.Fatalf("remaining waiter got %v, want the fetch result", res.err)
+			}
+		})
+	}
+}
@@ -10,16 +10,24 @@ import (
 	"net"
 	"os"
 	"time"
+
+	"gopl.io/pkg/logging"
+	"gopl.io/pkg/transport"
 )
 
 // handleConn accepts a network connection and writes the current time
 // each second until the client connection is closed.
-func handleConn(c net.Conn, loc *time.Location) {
+func handleConn(logger logging.Logger, c net.Conn, loc *time.Location) {
+	start := time.Now()
+	remoteAddr := c.RemoteAddr().String()
 	defer c.Close()
+
+	var written int64
 	for {
-		_, err := io.WriteString(c, time.Now().In(loc).Format("Mon Jan _2 2006 15:04:05-07:00\n"))
+		n, err := io.WriteString(c, time.Now().In(loc).Format("Mon Jan _2 2006 15:04:05-07:00\n"))
+		written += int64(n)
 		if err != nil {
-			log.Println("lost connection")
+			logger.Warn("connection closed", "remote_addr", remoteAddr, "duration", time.Since(start).String(), "bytes_written", written, "error", err.Error())
 			return
 		}
 
@@ -30,16 +38,29 @@ func handleConn(c net.Conn, loc *time.Location) {
 func main() {
 
 	var (
-		port int
-		addr string
-		tz   string
-		loc  *time.Location
+		port         int
+		addr         string
+		netFlag      string
+		certFile     string
+		keyFile      string
+		clientCAFile string
+		tz           string
+		loc          *time.Location
 	)
 
 	// command line args
 	flag.IntVar(&port, "port", 8000, "port to listen for connections on")
+	flag.StringVar(&addr, "addr", "", "listen address; a path starting with / selects a Unix socket (default localhost:-port)")
+	flag.StringVar(&netFlag, "net", "", "network transport: tcp, unix, or tls (default inferred from -addr)")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate file (required when -net=tls)")
+	flag.StringVar(&keyFile, "key", "", "TLS private key file (required when -net=tls)")
+	flag.StringVar(&clientCAFile, "client-ca", "", "PEM file of client CAs to require and verify for mutual TLS")
 	flag.Parse()
-	addr = fmt.Sprintf("localhost:%d", port)
+
+	if addr == "" {
+		addr = fmt.Sprintf("localhost:%d", port)
+	}
+	netw := transport.ResolveNet(netFlag, addr)
 
 	// Get env vars
 	if tz = os.Getenv("CLOCK_SERVER_TZ"); tz == "" {
@@ -52,22 +73,22 @@ func main() {
 		log.Fatal(err)
 	}
 
-	listener, err := net.Listen("tcp", addr)
+	listener, err := transport.NewListener(netw, addr, certFile, keyFile, clientCAFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Println("server started...")
+	logger := logging.Default
+	logger.Info("server started")
 	for {
-		log.Println("awaiting connections")
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Print(err)
+			logger.Warn("accept error", "error", err.Error())
 			continue
 		}
 
-		log.Println("handling connection")
-		go handleConn(conn, loc)
+		logger.Info("accepted connection", "remote_addr", conn.RemoteAddr().String())
+		go handleConn(logger, conn, loc)
 	}
 
 }
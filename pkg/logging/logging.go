@@ -0,0 +1,62 @@
+// Package logging provides the minimal structured Logger shared by reverb and clock.
+package logging
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Logger is a minimal structured logging interface satisfied by the default JSON logger and
+// adaptable to slog, zap, or logrus adapters.
+type Logger interface {
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// jsonLogger is the default Logger.  It writes one newline-delimited JSON record per log call.
+type jsonLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewJSONLogger returns a Logger that writes newline-delimited JSON records to out.
+func NewJSONLogger(out io.Writer) Logger {
+	return &jsonLogger{out: out}
+}
+
+// Default is the Logger used by a caller that hasn't configured one of its own.
+var Default = NewJSONLogger(os.Stdout)
+
+func (l *jsonLogger) Info(msg string, kv ...interface{}) { l.write("info", msg, kv) }
+
+func (l *jsonLogger) Warn(msg string, kv ...interface{}) { l.write("warn", msg, kv) }
+
+func (l *jsonLogger) Error(msg string, kv ...interface{}) { l.write("error", msg, kv) }
+
+func (l *jsonLogger) write(level, msg string, kv []interface{}) {
+	rec := make(map[string]interface{}, len(kv)/2+3)
+	rec["time"] = time.Now().Format(time.RFC3339Nano)
+	rec["level"] = level
+	rec["msg"] = msg
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		rec[key] = kv[i+1]
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(data)
+}
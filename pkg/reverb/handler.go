@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"gopl.io/pkg/logging"
+)
+
+// Handler handles a single accepted connection.  Implementations are expected to close c before
+// returning.
+type Handler interface {
+	ServeConn(ctx context.Context, c net.Conn)
+}
+
+// HandlerFunc adapts a plain function to a Handler.
+type HandlerFunc func(ctx context.Context, c net.Conn)
+
+// ServeConn calls f(ctx, c).
+func (f HandlerFunc) ServeConn(ctx context.Context, c net.Conn) {
+	f(ctx, c)
+}
+
+// Middleware wraps a Handler with additional behavior, the same shape as net/http's middleware
+// pattern.
+type Middleware func(Handler) Handler
+
+// Chain applies middleware to handler in order, so the first middleware in mw is the outermost
+// one run for each connection.
+func Chain(handler Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+	return handler
+}
+
+// NewEchoHandler returns the built-in handler implementing reverb's original echo-back-the-shout
+// protocol.  Each connection's outcome is reported through logger.
+func NewEchoHandler(logger logging.Logger) Handler {
+	return HandlerFunc(func(_ context.Context, c net.Conn) {
+		handleConn(logger, c)
+	})
+}
+
+// requestIDKey is the context key under which RequestID stores the per-connection request ID.
+type requestIDKey struct{}
+
+// RequestID assigns each connection an incrementing ID and attaches it to the context so that
+// downstream middleware and handlers can correlate log lines for one connection.
+func RequestID() Middleware {
+	var next uint64
+	return func(h Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c net.Conn) {
+			id := atomic.AddUint64(&next, 1)
+			h.ServeConn(context.WithValue(ctx, requestIDKey{}, id), c)
+		})
+	}
+}
+
+// requestID returns the request ID attached to ctx by RequestID, or 0 if none is present.
+func requestID(ctx context.Context) uint64 {
+	id, _ := ctx.Value(requestIDKey{}).(uint64)
+	return id
+}
+
+// Logging logs the start and completion of every connection via logger, including its request
+// ID, remote address, and duration.
+func Logging(logger logging.Logger) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c net.Conn) {
+			start := time.Now()
+			id := requestID(ctx)
+			logger.Info("connection accepted", "request_id", id, "remote_addr", c.RemoteAddr().String())
+			h.ServeConn(ctx, c)
+			logger.Info("connection handled", "request_id", id, "remote_addr", c.RemoteAddr().String(), "duration", time.Since(start).String())
+		})
+	}
+}
+
+// Recover catches a panic raised by a downstream handler, logs it via logger, and closes the
+// connection instead of letting the accept goroutine crash the server.
+func Recover(logger logging.Logger) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c net.Conn) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error("recovered from panic", "request_id", requestID(ctx), "remote_addr", c.RemoteAddr().String(), "panic", fmt.Sprint(r))
+					c.Close()
+				}
+			}()
+			h.ServeConn(ctx, c)
+		})
+	}
+}
+
+// MaxConns limits the number of connections handled concurrently to n, blocking further
+// connections until one finishes.
+func MaxConns(n int) Middleware {
+	sem := make(chan struct{}, n)
+	return func(h Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c net.Conn) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			h.ServeConn(ctx, c)
+		})
+	}
+}
+
+// Deadlines sets a read/write deadline of d on every connection before handing it to the next
+// handler.  A non-positive d leaves the connection's deadline unset.
+func Deadlines(d time.Duration) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c net.Conn) {
+			if d > 0 {
+				c.SetDeadline(time.Now().Add(d))
+			}
+			h.ServeConn(ctx, c)
+		})
+	}
+}
+
+// countingConn wraps a net.Conn to tally bytes written to it, so a handler can report how much
+// it sent without threading a counter through every write call.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countingConn) bytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
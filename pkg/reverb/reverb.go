@@ -4,15 +4,30 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
 	"time"
+
+	"gopl.io/pkg/logging"
+	"gopl.io/pkg/transport"
+)
+
+// ErrServerClosed is returned by Server.Serve after Shutdown or Close has been called.
+var ErrServerClosed = errors.New("reverb: server closed")
+
+// minAcceptBackoff and maxAcceptBackoff bound the exponential backoff applied between retries of
+// a temporary Accept error.
+const (
+	minAcceptBackoff = 1 * time.Millisecond
+	maxAcceptBackoff = 1 * time.Second
 )
 
 // echo writes three values of shout to the given connection.  Each value is written after a
@@ -25,116 +40,314 @@ func echo(c net.Conn, shout string, delay time.Duration) {
 	fmt.Fprintf(c, "\t%s\n", strings.ToLower(shout))
 }
 
-// heartbeat logs a pulse every 2500 ms until stopped
-func heartbeat(stop chan int) {
+// heartbeat logs a pulse event every 2500 ms, including the number of currently open
+// connections, until stopped.
+func (s *Server) heartbeat(stop chan int) {
 	for {
 		select {
 		case <-stop:
-			log.Println("stopped heartbeat")
+			s.logger.Info("heartbeat stopped")
 			return
 
 		case <-time.After(2500 * time.Millisecond):
-			log.Println("pulse")
+			s.logger.Info("pulse", "event", "pulse", "open_conns", s.openConns())
 		}
 	}
 }
 
 // handleConn scans the connection and converts the found input into text for echoing back on the
-// connection.
-func handleConn(c net.Conn) {
-	input := bufio.NewScanner(c)
+// connection, reporting the outcome through logger.
+func handleConn(logger logging.Logger, c net.Conn) {
+	start := time.Now()
+	cc := &countingConn{Conn: c}
+
+	input := bufio.NewScanner(cc)
 	for input.Scan() {
-		go echo(c, input.Text(), 1*time.Second)
+		go echo(cc, input.Text(), 1*time.Second)
+	}
+	err := input.Err()
+	cc.Close()
+
+	kv := []interface{}{
+		"remote_addr", c.RemoteAddr().String(),
+		"duration", time.Since(start).String(),
+		"bytes_written", cc.bytesWritten(),
 	}
-	c.Close()
+	if err != nil {
+		logger.Warn("connection closed", append(kv, "error", err.Error())...)
+		return
+	}
+	logger.Info("connection closed", kv...)
 }
 
-// handleConnStream handles each connection it pulls from a connection stream and stops when
-// the stop channel is closed.
-func handleConnStream(stop chan int, stream chan net.Conn) {
-	for {
-		select {
-		case <-stop:
-			log.Println("closing reverb client connection handler")
-			return
+// parseListenSpec splits a listener spec of the form "network://address", e.g.
+// "tcp://:8000" or "unix:///tmp/reverb.sock", into its network and address parts.
+func parseListenSpec(spec string) (netw, addr string, err error) {
+	parts := strings.SplitN(spec, "://", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid listen spec %q, want network://address", spec)
+	}
+	return parts[0], parts[1], nil
+}
 
-		case conn := <-stream:
-			log.Println("handling connection")
-			go handleConn(conn)
+// ListenAll opens one listener per spec (see parseListenSpec for the expected format), sharing
+// the given TLS certificate/key/client CA across any "tls" specs.  If any spec fails to listen,
+// the listeners already opened are closed before returning the error.
+func ListenAll(specs []string, certFile, keyFile, clientCAFile string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(specs))
+	for _, spec := range specs {
+		netw, addr, err := parseListenSpec(spec)
+		if err != nil {
+			closeAll(listeners)
+			return nil, err
 		}
+
+		l, err := transport.NewListener(netw, addr, certFile, keyFile, clientCAFile)
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("listen %s: %w", spec, err)
+		}
+
+		listeners = append(listeners, l)
 	}
+
+	return listeners, nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// Server accepts reverb connections and keeps track of every connection it has handed off, so
+// that it can wait for them to finish on a graceful Shutdown.  Each connection is served by
+// handler, wrapped with the configured middleware.
+type Server struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	closed    bool
+	handler   Handler
+	logger    logging.Logger
 }
 
-// serve launches a listener that waits for new connections and places those connections on a
-// connection stream.  serve shuts itself down once the stop channel is closed.
-func serve(stop chan int, addr string) error {
+// NewServer returns a Server ready to Serve a listener, logging through logging.Default until
+// WithLogger replaces it.  mw is applied to handler in order, so the first middleware is the
+// outermost one run for each connection.
+func NewServer(handler Handler, mw ...Middleware) *Server {
+	return &Server{
+		conns:   make(map[net.Conn]struct{}),
+		handler: Chain(handler, mw...),
+		logger:  logging.Default,
+	}
+}
+
+// WithLogger replaces the Server's Logger, e.g. with an adapter to slog, zap, or logrus, and
+// returns s for chaining.
+func (s *Server) WithLogger(logger logging.Logger) *Server {
+	s.logger = logger
+	return s
+}
+
+// nextBackoff doubles prev, floors it at minAcceptBackoff and caps it at maxAcceptBackoff, then
+// jitters the result so that repeated Accept failures don't retry in lockstep.
+func nextBackoff(prev time.Duration) time.Duration {
+	next := prev * 2
+	if next < minAcceptBackoff {
+		next = minAcceptBackoff
+	}
+	if next > maxAcceptBackoff {
+		next = maxAcceptBackoff
+	}
+	return next/2 + time.Duration(rand.Int63n(int64(next/2+1)))
+}
+
+// Serve runs an Accept loop on every listener, each in its own goroutine, and hands every
+// accepted connection to the server's handler in its own goroutine in turn.  It blocks until
+// every listener's Accept loop has exited, then returns the first error any listener's Accept
+// loop stopped on, even if the server was later shut down, or ErrServerClosed if every loop
+// exited because the server was shut down or closed.  A temporary Accept error is retried
+// with exponential backoff rather than spinning the accept loop.
+func (s *Server) Serve(listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		return errors.New("reverb: Serve requires at least one listener")
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		closeAll(listeners)
+		return ErrServerClosed
+	}
+	s.listeners = listeners
+	s.mu.Unlock()
+
 	var (
 		wg         sync.WaitGroup
-		listener   net.Listener
-		done       = make(chan int)
+		errOnce    sync.Once
+		firstErr   error
 		connStream = make(chan net.Conn)
 	)
 
-	// Create a new listener
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return NewReverbServerStartUpError(err)
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			if err := s.acceptLoop(l, connStream); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(l)
 	}
 
-	// Launch connection handler, stop listening if conn handler stops
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
-		handleConnStream(stop, connStream)
-		listener.Close()
+		wg.Wait()
+		close(connStream)
 	}()
 
-	// Launch hearbeat service
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		heartbeat(stop)
-	}()
+	for conn := range connStream {
+		s.trackConn(conn)
+		s.logger.Info("accepted connection", "remote_addr", conn.RemoteAddr().String())
+		go func(conn net.Conn) {
+			defer s.untrackConn(conn)
+			s.handler.ServeConn(context.Background(), conn)
+		}(conn)
+	}
 
-	// Wait for connection handler to finish to know server is done handling
-	go func() {
-		defer close(done)
-		wg.Wait()
-	}()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ErrServerClosed
+}
 
-	// Accept server connections until stopped, exit server when done cleaning up
-	log.Println("reverb server started...")
+// acceptLoop accepts connections on l and places them on connStream until the server is shut
+// down or closed, in which case it returns nil, or until Accept fails for a non-temporary
+// reason, in which case it returns that error.
+func (s *Server) acceptLoop(l net.Listener, connStream chan<- net.Conn) error {
+	var backoff time.Duration
 	for {
-		select {
-		case <-done:
-			log.Println("reverb server stopped")
-			return nil
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
 
-		case <-stop:
-			log.Println("stopping reverb server")
-		default:
-			log.Println("awaiting connections")
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Println(err)
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				backoff = nextBackoff(backoff)
+				s.logger.Warn("accept error, retrying", "listener_addr", l.Addr().String(), "error", err.Error(), "backoff", backoff.String())
+				time.Sleep(backoff)
 				continue
 			}
 
-			connStream <- conn
+			return err
+		}
+		backoff = 0
+
+		connStream <- conn
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) trackConn(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = struct{}{}
+}
+
+func (s *Server) untrackConn(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+func (s *Server) openConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// closeConns force-closes every tracked connection.
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+		delete(s.conns, c)
+	}
+}
+
+// closeListeners closes every listener and removes the socket file behind any Unix listener
+// among them.  Callers must hold s.mu.
+func (s *Server) closeListeners() error {
+	var err error
+	for _, l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if l.Addr().Network() == "unix" {
+			os.Remove(l.Addr().String())
+		}
+	}
+	return err
+}
+
+// Shutdown closes every listener so no new connections are accepted, then waits for tracked
+// connections to finish on their own until ctx is done, at which point any still open are
+// force-closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.closeListeners()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for s.openConns() > 0 {
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
 		}
 	}
+
+	return nil
+}
+
+// Close closes every listener and immediately force-closes every tracked connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	err := s.closeListeners()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.closeConns()
+	return err
 }
 
 // main launches a reverb server and waits for a system interrupt to gracefully shutdown the reverb
 // server.
 func main() {
 	var (
-		port      int
-		addr      string
-		wg        sync.WaitGroup
-		interrupt = make(chan os.Signal, 1)
-		shutdown  = make(chan int)
-		done      = make(chan int)
+		port            int
+		addr            string
+		netFlag         string
+		listenSpecs     string
+		certFile        string
+		keyFile         string
+		clientCAFile    string
+		shutdownTimeout time.Duration
+		connDeadline    time.Duration
+		maxConns        int
+		interrupt       = make(chan os.Signal, 1)
+		stopHeartbeat   = make(chan int)
 	)
 
 	// Notify main of any interruptions
@@ -142,37 +355,70 @@ func main() {
 
 	// Fetch command line args
 	flag.IntVar(&port, "port", 8000, "port to listen for connections on")
+	flag.StringVar(&addr, "addr", "", "listen address; a path starting with / selects a Unix socket (default localhost:-port)")
+	flag.StringVar(&netFlag, "net", "", "network transport: tcp, unix, or tls (default inferred from -addr)")
+	flag.StringVar(&listenSpecs, "listen", "", "comma-separated listener specs, e.g. tcp://:8000,tls://:8443,unix:///tmp/reverb.sock (overrides -net/-addr/-port)")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate file (required when -net=tls)")
+	flag.StringVar(&keyFile, "key", "", "TLS private key file (required when -net=tls)")
+	flag.StringVar(&clientCAFile, "client-ca", "", "PEM file of client CAs to require and verify for mutual TLS")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 5*time.Second, "how long to wait for open connections to drain on shutdown")
+	flag.DurationVar(&connDeadline, "conn-deadline", 0, "read/write deadline applied to each connection (0 disables it)")
+	flag.IntVar(&maxConns, "max-conns", 100, "maximum number of connections handled concurrently")
 	flag.Parse()
-	addr = fmt.Sprintf("localhost:%d", port)
 
-	// Launch server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := serve(shutdown, addr)
-		if err != nil {
-			// could not serve, log and shut down
-			log.Println(err)
-			return
+	var (
+		listeners []net.Listener
+		err       error
+	)
+	if listenSpecs != "" {
+		listeners, err = ListenAll(strings.Split(listenSpecs, ","), certFile, keyFile, clientCAFile)
+	} else {
+		if addr == "" {
+			addr = fmt.Sprintf("localhost:%d", port)
 		}
-	}()
+		netw := transport.ResolveNet(netFlag, addr)
 
-	// Launch shutdown watcher
+		var listener net.Listener
+		listener, err = transport.NewListener(netw, addr, certFile, keyFile, clientCAFile)
+		if listener != nil {
+			listeners = []net.Listener{listener}
+		}
+	}
+	logger := logging.Default
+	if err != nil {
+		logger.Error("startup failed", "error", NewReverbServerStartUpError(err).Error())
+		return
+	}
+
+	handler := NewEchoHandler(logger)
+	srv := NewServer(handler, Recover(logger), RequestID(), Logging(logger), MaxConns(maxConns), Deadlines(connDeadline)).WithLogger(logger)
+	go srv.heartbeat(stopHeartbeat)
+
+	serveErr := make(chan error, 1)
+	logger.Info("reverb server started")
 	go func() {
-		wg.Wait()
-		close(done)
+		serveErr <- srv.Serve(listeners...)
 	}()
 
 	// Handle graceful shutdown
-	for {
-		select {
-		case <-done:
-			log.Println("shutdown complete, goodbye")
-			return
+	select {
+	case err := <-serveErr:
+		close(stopHeartbeat)
+		if err != nil && err != ErrServerClosed {
+			logger.Error("server stopped", "error", err.Error())
+		}
+
+	case <-interrupt:
+		logger.Info("starting graceful shutdown")
+		close(stopHeartbeat)
 
-		case <-interrupt:
-			log.Println("starting graceful shutdown")
-			close(shutdown)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Error("shutdown failed", "error", NewReverbServerShutDownError(err).Error())
 		}
+		<-serveErr
 	}
+
+	logger.Info("shutdown complete, goodbye")
 }
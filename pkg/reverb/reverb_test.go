@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeAfterShutdownReturnsErrServerClosed(t *testing.T) {
+	srv := NewServer(HandlerFunc(func(_ context.Context, c net.Conn) { c.Close() }))
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown on a fresh server: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	if err := srv.Serve(l); err != ErrServerClosed {
+		t.Fatalf("Serve after Shutdown returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestShutdownDrainsOpenConnections(t *testing.T) {
+	release := make(chan struct{})
+	srv := NewServer(HandlerFunc(func(_ context.Context, c net.Conn) {
+		defer c.Close()
+		<-release
+	}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for srv.openConns() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection was never tracked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- srv.Shutdown(context.Background()) }()
+
+	select {
+	case <-shutdownDone:
+		t.Fatalf("Shutdown returned before the open connection finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	if err := <-shutdownDone; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
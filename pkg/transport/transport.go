@@ -0,0 +1,81 @@
+// Package transport provides the tcp/unix/tls listener construction shared by reverb and clock.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ResolveNet returns the network to listen on.  When netw is empty it is inferred from addr: a
+// leading "/" selects a Unix domain socket, otherwise TCP is used.
+func ResolveNet(netw, addr string) string {
+	if netw != "" {
+		return netw
+	}
+	if strings.HasPrefix(addr, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// loadTLSConfig builds a server tls.Config from the given certificate/key pair.  When
+// clientCAFile is non-empty, client certificates are verified against it and mutual TLS is
+// required.
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse client CA certificate %s", clientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// NewListener opens a listener for netw/addr, wrapping it in TLS when netw is "tls".  A Unix
+// socket addr is cleared of any stale file left behind by a previous run before binding.
+func NewListener(netw, addr, certFile, keyFile, clientCAFile string) (net.Listener, error) {
+	dialNet := netw
+	if dialNet == "tls" {
+		dialNet = "tcp"
+	}
+
+	if dialNet == "unix" {
+		os.Remove(addr)
+	}
+
+	listener, err := net.Listen(dialNet, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if netw == "tls" {
+		tlsConfig, err := loadTLSConfig(certFile, keyFile, clientCAFile)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	return listener, nil
+}